@@ -0,0 +1,37 @@
+package wazero
+
+import "testing"
+
+// TestAllowList_nilAllowsEverything confirms a Manifest with no AllowedHosts
+// (newAllowList(nil)) allows any namespace/operation pair, matching the
+// behavior of a wapc.Module created without a Manifest.
+func TestAllowList_nilAllowsEverything(t *testing.T) {
+	allow := newAllowList(nil)
+	if allow != nil {
+		t.Fatalf("newAllowList(nil) = %v, want nil", allow)
+	}
+	if !allow.allowed("kv", "get") {
+		t.Error("allowed(kv, get) = false, want true for a nil allowList")
+	}
+}
+
+// TestAllowList_gatesToExactPairs confirms a non-empty AllowedHosts list
+// allows only the exact "namespace/operation" pairs it names.
+func TestAllowList_gatesToExactPairs(t *testing.T) {
+	allow := newAllowList([]string{"kv/get", "kv/set"})
+
+	cases := []struct {
+		namespace, operation string
+		want                 bool
+	}{
+		{"kv", "get", true},
+		{"kv", "set", true},
+		{"kv", "delete", false},
+		{"other", "get", false},
+	}
+	for _, c := range cases {
+		if got := allow.allowed(c.namespace, c.operation); got != c.want {
+			t.Errorf("allowed(%q, %q) = %v, want %v", c.namespace, c.operation, got, c.want)
+		}
+	}
+}
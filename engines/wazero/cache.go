@@ -0,0 +1,49 @@
+package wazero
+
+import (
+	"context"
+
+	"github.com/tetratelabs/wazero"
+
+	"github.com/wapc/wapc-go"
+)
+
+// WithCompilationCache returns a wapc.Engine like Engine, except guest modules
+// are compiled through a wazero.CompilationCache rooted at dir. This lets
+// long-running services and CLI tools skip the multi-second optimizing
+// compile on every boot, and lets horizontally-scaled hosts share a cache
+// directory on a mounted volume.
+//
+// The cache key wazero derives incorporates a hash of the guest bytes and the
+// wazero API version, so stale entries from a previous guest build or engine
+// upgrade are ignored rather than reused.
+//
+// Note: the cache outlives any individual wapc.Module - closing a Module (and
+// its underlying wazero.Runtime) does not close files under dir. Callers that
+// want to release the cache explicitly should use EngineWithCompilationCache
+// with a cache they manage themselves.
+func WithCompilationCache(dir string) (wapc.Engine, error) {
+	cache, err := wazero.NewCompilationCacheWithDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	return EngineWithCompilationCache(cache), nil
+}
+
+// EngineWithCompilationCache returns a wapc.Engine like Engine, except it
+// compiles guest modules through cache instead of recompiling them on every
+// wapc.Engine.New call. Use this instead of WithCompilationCache when cache is
+// shared across multiple engines or its lifecycle is managed independently of
+// any single wapc.Module.
+func EngineWithCompilationCache(cache wazero.CompilationCache) wapc.Engine {
+	return &engine{newRuntime: newRuntimeWithCompilationCache(cache)}
+}
+
+// newRuntimeWithCompilationCache returns a NewRuntime that behaves like
+// DefaultRuntime, except compiled modules are looked up in and stored to
+// cache.
+func newRuntimeWithCompilationCache(cache wazero.CompilationCache) NewRuntime {
+	return func(ctx context.Context) (wazero.Runtime, error) {
+		return newRuntime(ctx, wazero.NewRuntimeConfig().WithCompilationCache(cache))
+	}
+}
@@ -0,0 +1,64 @@
+package wazero
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/wapc/wapc-go"
+)
+
+// TestWithCompilationCache_roundTrip confirms WithCompilationCache populates
+// dir on first compile and that a second engine rooted at the same dir can
+// still instantiate the guest, i.e. the cache directory is usable across
+// separate wapc.Engine instances rather than just within one.
+func TestWithCompilationCache_roundTrip(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	guest, err := os.ReadFile("testdata/fuelloop.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eng, err := WithCompilationCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := eng.New(ctx, wapc.NoOpHostCallHandler, guest, &wapc.ModuleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance, err := m.Instantiate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance.Close(ctx)
+	m.Close(ctx)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Fatal("cache dir is empty after compiling a guest, want it populated")
+	}
+
+	// A second engine rooted at the same (now populated) cache dir must still
+	// be able to compile and instantiate the same guest.
+	eng2, err := WithCompilationCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := eng2.New(ctx, wapc.NoOpHostCallHandler, guest, &wapc.ModuleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m2.Close(ctx)
+	instance2, err := m2.Instantiate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance2.Close(ctx)
+}
@@ -0,0 +1,62 @@
+package wazero
+
+import (
+	"context"
+	"strings"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/assemblyscript"
+	"github.com/tetratelabs/wazero/imports/emscripten"
+
+	"github.com/wapc/wapc-go"
+)
+
+// EngineWithEmscripten returns a wapc.Engine like Engine, except guests are
+// inspected after compilation for emscripten's required "env" imports (e.g.
+// invoke_ii, emscripten_notify_memory_growth, __syscall_*), which are then
+// synthesized and exported alongside the existing waPC and AssemblyScript host
+// functions. This allows guests compiled with emcc to instantiate.
+func EngineWithEmscripten() wapc.Engine {
+	return &engine{newRuntime: DefaultRuntime, emscripten: true}
+}
+
+// instantiateEnvModule builds and instantiates the "env" host module shared by
+// AssemblyScript guests and, when wantEmscripten is true and compiled needs
+// it, emscripten guests. It must run after compiled is available, since the
+// emscripten trampolines it exports are derived from compiled's imports.
+func instantiateEnvModule(ctx context.Context, r wazero.Runtime, compiled wazero.CompiledModule, wantEmscripten bool) error {
+	envBuilder := r.NewHostModuleBuilder("env")
+
+	// This disables the abort message as no other engines write it.
+	assemblyscript.NewFunctionExporter().WithAbortMessageDisabled().ExportFunctions(envBuilder)
+
+	if wantEmscripten && needsEmscripten(compiled) {
+		exporter, err := emscripten.NewFunctionExporterForModule(compiled)
+		if err != nil {
+			return err
+		}
+		exporter.ExportFunctions(envBuilder)
+	}
+
+	_, err := envBuilder.Instantiate(ctx)
+	return err
+}
+
+// needsEmscripten returns true if compiled imports any "env" function that
+// looks like it was emitted by emcc, e.g. an invoke_* trampoline or an
+// emscripten_*/__syscall_* runtime call.
+func needsEmscripten(compiled wazero.CompiledModule) bool {
+	for _, imp := range compiled.ImportedFunctions() {
+		moduleName, name, _ := imp.Import()
+		if moduleName != "env" {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(name, "invoke_"),
+			strings.HasPrefix(name, "emscripten_"),
+			strings.HasPrefix(name, "__syscall_"):
+			return true
+		}
+	}
+	return false
+}
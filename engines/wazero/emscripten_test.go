@@ -0,0 +1,46 @@
+package wazero
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// TestNeedsEmscripten exercises needsEmscripten's import-name heuristic
+// against hand-built modules importing a single "env" function each, rather
+// than a real emcc-compiled guest.
+func TestNeedsEmscripten(t *testing.T) {
+	tests := []struct {
+		name string
+		wasm string
+		want bool
+	}{
+		{"emscripten invoke_ trampoline", "testdata/emscripten-import.wasm", true},
+		{"unrelated env import", "testdata/plain-import.wasm", false},
+		{"no imports at all", "testdata/fuelloop.wasm", false},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guest, err := os.ReadFile(tt.wasm)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := wazero.NewRuntime(ctx)
+			defer r.Close(ctx)
+
+			compiled, err := r.CompileModule(ctx, guest)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := needsEmscripten(compiled); got != tt.want {
+				t.Errorf("needsEmscripten(%s) = %v, want %v", tt.wasm, got, tt.want)
+			}
+		})
+	}
+}
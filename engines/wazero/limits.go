@@ -0,0 +1,163 @@
+package wazero
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// wasiExitCodeDeadlineExceeded is the exit code CloseWithExitCode is called
+// with when a WithDeadline InvokeOption expires.
+const wasiExitCodeDeadlineExceeded uint32 = 1
+
+// TimeoutError is returned by Instance.Invoke (via InvokeWithOptions) when a
+// WithDeadline InvokeOption expires before __guest_call returns.
+type TimeoutError struct {
+	// Operation is the name passed to Invoke.
+	Operation string
+	// Deadline is the WithDeadline duration that was exceeded.
+	Deadline time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("wapc: call to %q exceeded its deadline of %s", e.Operation, e.Deadline)
+}
+
+// FuelExhaustedError is returned by Instance.Invoke (via InvokeWithOptions)
+// when a WithFuel InvokeOption's call budget is exhausted before
+// __guest_call returns.
+type FuelExhaustedError struct {
+	// Operation is the name passed to Invoke.
+	Operation string
+	// Fuel is the WithFuel budget that was exhausted.
+	Fuel uint64
+}
+
+func (e *FuelExhaustedError) Error() string {
+	return fmt.Sprintf("wapc: call to %q exhausted its fuel budget of %d function calls", e.Operation, e.Fuel)
+}
+
+// InvokeOption configures a single Instance.InvokeWithOptions call.
+type InvokeOption interface{ apply(*invokeOptions) }
+
+type invokeOptionFunc func(*invokeOptions)
+
+func (f invokeOptionFunc) apply(o *invokeOptions) { f(o) }
+
+// WithDeadline bounds a single Invoke call: if __guest_call has not returned
+// within d, the instance's underlying api.Module is forcibly closed and
+// Invoke returns a *TimeoutError. The Instance (and any other in-flight call
+// on it) is unusable afterward, same as after Instance.Close.
+func WithDeadline(d time.Duration) InvokeOption {
+	return invokeOptionFunc(func(o *invokeOptions) { o.deadline = d })
+}
+
+// WithFuel bounds a single Invoke call to at most n exported or host function
+// calls, using a wazero experimental.FunctionListenerFactory to count them.
+// Once exceeded, the call is aborted and Invoke returns a
+// *FuelExhaustedError. This guards against untrusted guests that would
+// otherwise run (or loop) indefinitely without cooperating with Close.
+func WithFuel(n uint64) InvokeOption {
+	return invokeOptionFunc(func(o *invokeOptions) { o.fuel = n })
+}
+
+type invokeOptions struct {
+	deadline time.Duration
+	fuel     uint64
+}
+
+// apply wires o's limits into ctx and returns an invokeLimit that
+// InvokeWithOptions consults after the underlying guestCall.Call returns (or
+// fails) to distinguish a timeout or fuel exhaustion from any other error.
+func (o invokeOptions) apply(ctx context.Context, m api.Module) (context.Context, *invokeLimit) {
+	lim := &invokeLimit{}
+
+	if o.deadline > 0 {
+		lim.timer = time.AfterFunc(o.deadline, func() {
+			atomic.StoreUint32(&lim.timedOutFlag, 1)
+			_ = m.CloseWithExitCode(context.Background(), wasiExitCodeDeadlineExceeded)
+		})
+	}
+
+	if o.fuel > 0 {
+		// wazero only consults a FunctionListenerFactory installed on the
+		// context passed to Runtime.CompileModule (see engine.New), so the
+		// per-call budget itself travels separately, keyed on this call's
+		// ctx; fuelListenerFactory's Before reads it back from there.
+		lim.fuelMax = o.fuel
+		ctx = newFuelContext(ctx, lim)
+	}
+
+	return ctx, lim
+}
+
+// invokeLimit tracks whether a bounded Invoke call tripped a WithDeadline or
+// WithFuel limit.
+type invokeLimit struct {
+	timer             *time.Timer
+	timedOutFlag      uint32
+	fuelMax           uint64
+	fuelCount         uint64
+	fuelExhaustedFlag uint32
+}
+
+func (l *invokeLimit) stop() {
+	if l != nil && l.timer != nil {
+		l.timer.Stop()
+	}
+}
+
+func (l *invokeLimit) timedOut() bool {
+	return l != nil && atomic.LoadUint32(&l.timedOutFlag) == 1
+}
+
+func (l *invokeLimit) fuelExhausted() bool {
+	return l != nil && atomic.LoadUint32(&l.fuelExhaustedFlag) == 1
+}
+
+type fuelContextKey struct{}
+
+// newFuelContext associates lim with ctx so fuelListenerFactory.Before, which
+// runs against whatever ctx a given guestCall.Call was made with, can find
+// the budget (if any) for that specific call.
+func newFuelContext(ctx context.Context, lim *invokeLimit) context.Context {
+	return context.WithValue(ctx, fuelContextKey{}, lim)
+}
+
+// fuelListenerFactory implements experimental.FunctionListenerFactory. A
+// single instance is installed on every module this package's engines
+// compile (see engine.New's use of experimental.WithFunctionListenerFactory)
+// because wazero only builds a module's function listeners once, from the
+// context passed to Runtime.CompileModule -- long before any particular
+// Invoke call's WithFuel budget (if any) exists. fuelListenerFactory is
+// itself stateless: Before instead looks up the current call's budget via
+// newFuelContext, so unrelated concurrent Invoke calls on the same module
+// count their own function calls independently.
+type fuelListenerFactory struct{}
+
+func (fuelListenerFactory) NewFunctionListener(api.FunctionDefinition) experimental.FunctionListener {
+	return fuelListenerFactory{}
+}
+
+func (fuelListenerFactory) Before(ctx context.Context, _ api.Module, _ api.FunctionDefinition, _ []uint64, _ experimental.StackIterator) {
+	lim, ok := ctx.Value(fuelContextKey{}).(*invokeLimit)
+	if !ok {
+		return // this call wasn't made with WithFuel
+	}
+	if atomic.AddUint64(&lim.fuelCount, 1) > lim.fuelMax {
+		atomic.StoreUint32(&lim.fuelExhaustedFlag, 1)
+		panic(fmt.Sprintf("wapc: fuel exhausted after %d function calls", lim.fuelMax))
+	}
+}
+
+func (fuelListenerFactory) After(context.Context, api.Module, api.FunctionDefinition, []uint64) {}
+
+// Abort is invoked instead of After when Before's panic unwinds the call as a
+// trap, which is how WithFuel's exhausted flag actually reaches the caller:
+// InvokeWithOptions sees guestCall.Call fail and consults invokeLimit to
+// distinguish this from any other runtime error.
+func (fuelListenerFactory) Abort(context.Context, api.Module, api.FunctionDefinition, error) {}
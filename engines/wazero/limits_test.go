@@ -0,0 +1,50 @@
+package wazero
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/wapc/wapc-go"
+)
+
+// TestWithFuel_tripsOnGuestLoop compiles testdata/fuelloop.wasm, whose
+// "__guest_call" export loops calling another guest-defined function up to
+// 100,000 times, and confirms WithFuel aborts the call well before the loop
+// would otherwise finish.
+func TestWithFuel_tripsOnGuestLoop(t *testing.T) {
+	ctx := context.Background()
+
+	guest, err := os.ReadFile("testdata/fuelloop.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := Engine().New(ctx, wapc.NoOpHostCallHandler, guest, &wapc.ModuleConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close(ctx)
+
+	genericInstance, err := m.Instantiate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer genericInstance.Close(ctx)
+
+	instance := genericInstance.(*Instance)
+
+	_, err = instance.InvokeWithOptions(ctx, "test", nil, WithFuel(10))
+
+	var fuelErr *FuelExhaustedError
+	if !errors.As(err, &fuelErr) {
+		t.Fatalf("InvokeWithOptions error = %v (%T), want *FuelExhaustedError", err, err)
+	}
+	if want := uint64(10); fuelErr.Fuel != want {
+		t.Errorf("FuelExhaustedError.Fuel = %d, want %d", fuelErr.Fuel, want)
+	}
+	if fuelErr.Operation != "test" {
+		t.Errorf("FuelExhaustedError.Operation = %q, want %q", fuelErr.Operation, "test")
+	}
+}
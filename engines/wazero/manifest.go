@@ -0,0 +1,231 @@
+package wazero
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/experimental"
+	"gopkg.in/yaml.v3"
+
+	"github.com/wapc/wapc-go"
+)
+
+// Manifest is a declarative description of a waPC workload for the wazero
+// backend: the guest module to run plus the WASI configuration, resource
+// limits, and host-call allow list it should run under. It is the wazero
+// analog of Extism's plugin manifest, letting operators ship a single JSON or
+// YAML artifact instead of bespoke Go glue.
+type Manifest struct {
+	// Wasm locates the guest bytes. Exactly one of Wasm.Path, Wasm.URL, or
+	// Wasm.Bytes must be set.
+	Wasm ManifestWasm `json:"wasm" yaml:"wasm"`
+
+	// Env are WASI environment variables exposed to the guest.
+	Env map[string]string `json:"env,omitempty" yaml:"env,omitempty"`
+
+	// Args are WASI program arguments exposed to the guest as argv.
+	Args []string `json:"args,omitempty" yaml:"args,omitempty"`
+
+	// PreopenDirs maps guest-visible paths to host directories made available
+	// through WASI preopens.
+	PreopenDirs map[string]string `json:"preopenDirs,omitempty" yaml:"preopenDirs,omitempty"`
+
+	// AllowedHosts lists the "namespace/operation" host-call pairs the guest
+	// may invoke, e.g. "kv/get". A nil or empty list allows all host calls.
+	AllowedHosts []string `json:"allowedHosts,omitempty" yaml:"allowedHosts,omitempty"`
+
+	// MaxMemoryPages caps guest linear memory growth, in 64KB wazero pages. Zero
+	// means no cap beyond whatever the guest module itself declares.
+	MaxMemoryPages uint32 `json:"maxMemoryPages,omitempty" yaml:"maxMemoryPages,omitempty"`
+
+	// Timeout bounds a single Instance.Invoke call, applied via WithDeadline.
+	// Zero means no timeout. It has no effect on InvokeWithOptions, which
+	// callers use when they want to set their own bounds per call.
+	Timeout time.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+// ManifestWasm identifies the guest bytes for a Manifest. Exactly one field
+// must be set.
+type ManifestWasm struct {
+	// Path is a filesystem path to a .wasm file.
+	Path string `json:"path,omitempty" yaml:"path,omitempty"`
+
+	// URL is an HTTP(S) location for a .wasm file. Sha256 is required when URL
+	// is set, and is verified against the fetched bytes.
+	URL string `json:"url,omitempty" yaml:"url,omitempty"`
+
+	// Sha256 is the expected hex-encoded SHA-256 digest of the guest bytes
+	// fetched from URL.
+	Sha256 string `json:"sha256,omitempty" yaml:"sha256,omitempty"`
+
+	// Bytes is inline guest wasm, typically populated by an application that
+	// already has the module bytes rather than a path or URL.
+	Bytes []byte `json:"bytes,omitempty" yaml:"bytes,omitempty"`
+}
+
+// LoadManifest reads and parses a Manifest from path, using YAML for a
+// ".yaml"/".yml" extension and JSON otherwise.
+func LoadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("wapc: error reading manifest %s: %w", path, err)
+	}
+
+	man := &Manifest{}
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		err = yaml.Unmarshal(data, man)
+	} else {
+		err = json.Unmarshal(data, man)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("wapc: error parsing manifest %s: %w", path, err)
+	}
+	return man, nil
+}
+
+// guestBytes resolves the guest wasm named by w, fetching and verifying it
+// against Sha256 when URL is set.
+func (w ManifestWasm) guestBytes(ctx context.Context) ([]byte, error) {
+	switch {
+	case len(w.Bytes) > 0:
+		return w.Bytes, nil
+	case w.Path != "":
+		return os.ReadFile(w.Path)
+	case w.URL != "":
+		if w.Sha256 == "" {
+			return nil, fmt.Errorf("wapc: manifest wasm.sha256 is required when wasm.url is set")
+		}
+		return fetchAndVerify(ctx, w.URL, w.Sha256)
+	default:
+		return nil, fmt.Errorf("wapc: manifest must set exactly one of wasm.path, wasm.url, or wasm.bytes")
+	}
+}
+
+func fetchAndVerify(ctx context.Context, url, wantSha256 string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("wapc: error fetching %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("wapc: error reading %s: %w", url, err)
+	}
+
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); got != wantSha256 {
+		return nil, fmt.Errorf("wapc: %s sha256 mismatch: want %s, got %s", url, wantSha256, got)
+	}
+	return data, nil
+}
+
+// NewFromManifest builds and compiles a wapc.Module for the wazero backend
+// from man: it resolves the guest wasm, wires man's WASI env/args/preopens
+// into the wazero.ModuleConfig used for every Instantiate, enforces
+// MaxMemoryPages via wazero.RuntimeConfig, gates wapcHost.hostCall on
+// man.AllowedHosts so a disallowed namespace/operation pair fails the guest's
+// host call with ic.hostErr set instead of silently succeeding, and, when
+// man.Timeout is nonzero, defaults every Instance.Invoke call to a
+// WithDeadline of man.Timeout.
+func NewFromManifest(ctx context.Context, host wapc.HostCallHandler, man *Manifest) (wapc.Module, error) {
+	guest, err := man.Wasm.guestBytes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rConfig := wazero.NewRuntimeConfig()
+	if man.MaxMemoryPages > 0 {
+		rConfig = rConfig.WithMemoryLimitPages(man.MaxMemoryPages)
+	}
+
+	r, err := newRuntime(ctx, rConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Module{runtime: r, wapcHostCallHandler: host, hostFns: newHostFunctions()}
+	if man.Timeout > 0 {
+		m.defaultInvokeOpts = []InvokeOption{WithDeadline(man.Timeout)}
+	}
+
+	m.config = wazero.NewModuleConfig().
+		WithStartFunctions(functionStart, functionInit)
+	for k, v := range man.Env {
+		m.config = m.config.WithEnv(k, v)
+	}
+	if len(man.Args) > 0 {
+		m.config = m.config.WithArgs(man.Args...)
+	}
+	if len(man.PreopenDirs) > 0 {
+		fsConfig := wazero.NewFSConfig()
+		for guestPath, hostPath := range man.PreopenDirs {
+			fsConfig = fsConfig.WithDirMount(hostPath, guestPath)
+		}
+		m.config = m.config.WithFSConfig(fsConfig)
+	}
+
+	allow := newAllowList(man.AllowedHosts)
+	if _, err = instantiateWapcHostWithAllowList(ctx, r, m.wapcHostCallHandler, nil, m.hostFns, allow); err != nil {
+		_ = r.Close(ctx)
+		return nil, err
+	}
+
+	// See engine.New's use of experimental.WithFunctionListenerFactory: wazero
+	// only consults a FunctionListenerFactory from the ctx passed to
+	// CompileModule, so WithFuel on an Instance from this Module needs the
+	// same stateless fuelListenerFactory installed here.
+	compileCtx := experimental.WithFunctionListenerFactory(ctx, fuelListenerFactory{})
+	if m.compiled, err = r.CompileModule(compileCtx, guest); err != nil {
+		_ = r.Close(ctx)
+		return nil, err
+	}
+
+	if err = instantiateEnvModule(ctx, r, m.compiled, false); err != nil {
+		_ = r.Close(ctx)
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// allowList gates wapcHost.hostCall to a fixed set of "namespace/operation"
+// pairs. A nil allowList allows everything, matching the behavior of a
+// wapc.Module created without a Manifest.
+type allowList struct {
+	set map[string]struct{}
+}
+
+// newAllowList returns nil (allow everything) if pairs is empty.
+func newAllowList(pairs []string) *allowList {
+	if len(pairs) == 0 {
+		return nil
+	}
+	set := make(map[string]struct{}, len(pairs))
+	for _, p := range pairs {
+		set[p] = struct{}{}
+	}
+	return &allowList{set: set}
+}
+
+func (a *allowList) allowed(namespace, operation string) bool {
+	if a == nil {
+		return true
+	}
+	_, ok := a.set[hostFunctionKey(namespace, operation)]
+	return ok
+}
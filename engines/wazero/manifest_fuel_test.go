@@ -0,0 +1,50 @@
+package wazero
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/wapc/wapc-go"
+)
+
+// TestNewFromManifest_fuelTripsOnGuestLoop confirms a Module built via
+// NewFromManifest enforces WithFuel the same way Engine().New does: a
+// regression test for a bug where NewFromManifest compiled the guest through
+// a bare ctx, never installing fuelListenerFactory, so WithFuel silently
+// never tripped on modules built from a Manifest.
+func TestNewFromManifest_fuelTripsOnGuestLoop(t *testing.T) {
+	ctx := context.Background()
+
+	guest, err := os.ReadFile("testdata/fuelloop.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	man := &Manifest{Wasm: ManifestWasm{Bytes: guest}}
+
+	m, err := NewFromManifest(ctx, wapc.NoOpHostCallHandler, man)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close(ctx)
+
+	genericInstance, err := m.Instantiate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer genericInstance.Close(ctx)
+
+	instance := genericInstance.(*Instance)
+
+	_, err = instance.InvokeWithOptions(ctx, "test", nil, WithFuel(10))
+
+	var fuelErr *FuelExhaustedError
+	if !errors.As(err, &fuelErr) {
+		t.Fatalf("InvokeWithOptions error = %v (%T), want *FuelExhaustedError", err, err)
+	}
+	if want := uint64(10); fuelErr.Fuel != want {
+		t.Errorf("FuelExhaustedError.Fuel = %d, want %d", fuelErr.Fuel, want)
+	}
+}
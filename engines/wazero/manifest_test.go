@@ -0,0 +1,57 @@
+package wazero
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/wapc/wapc-go"
+)
+
+// TestNewFromManifest_preopensAllDirs compiles testdata/countpreopens.wasm,
+// whose "__guest_call" export counts the WASI preopens visible to the guest
+// via fd_prestat_get and returns the count as its response payload. With two
+// entries in Manifest.PreopenDirs, both must be mounted -- a regression test
+// for a bug where building FSConfig freshly on each loop iteration silently
+// dropped all but the last entry.
+func TestNewFromManifest_preopensAllDirs(t *testing.T) {
+	ctx := context.Background()
+
+	guest, err := os.ReadFile("testdata/countpreopens.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	man := &Manifest{
+		Wasm: ManifestWasm{Bytes: guest},
+		PreopenDirs: map[string]string{
+			"a": t.TempDir(),
+			"b": t.TempDir(),
+		},
+	}
+
+	m, err := NewFromManifest(ctx, wapc.NoOpHostCallHandler, man)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close(ctx)
+
+	instance, err := m.Instantiate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close(ctx)
+
+	resp, err := instance.Invoke(ctx, "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp) != 4 {
+		t.Fatalf("response = %v, want a 4-byte preopen count", resp)
+	}
+	if count := binary.LittleEndian.Uint32(resp); count != 2 {
+		t.Errorf("preopen count = %d, want 2 (one per PreopenDirs entry)", count)
+	}
+}
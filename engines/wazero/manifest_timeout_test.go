@@ -0,0 +1,48 @@
+package wazero
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/wapc/wapc-go"
+)
+
+// TestNewFromManifest_timeout confirms Manifest.Timeout is applied as a
+// default WithDeadline to every Instance.Invoke call: testdata/spinloop.wasm
+// loops far longer than the manifest's timeout, so Invoke must fail with a
+// *TimeoutError rather than run to completion.
+func TestNewFromManifest_timeout(t *testing.T) {
+	ctx := context.Background()
+
+	guest, err := os.ReadFile("testdata/spinloop.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	man := &Manifest{
+		Wasm:    ManifestWasm{Bytes: guest},
+		Timeout: 20 * time.Millisecond,
+	}
+
+	m, err := NewFromManifest(ctx, wapc.NoOpHostCallHandler, man)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close(ctx)
+
+	instance, err := m.Instantiate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close(ctx)
+
+	_, err = instance.Invoke(ctx, "test", nil)
+
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("Invoke error = %v (%T), want *TimeoutError", err, err)
+	}
+}
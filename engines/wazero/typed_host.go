@@ -0,0 +1,126 @@
+package wazero
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// hostFunctions indexes host functions registered via Module.RegisterHostFunction
+// by "namespace/operation", and is consulted by wapcHost.hostCall before
+// falling back to the Module's wapc.HostCallHandler.
+type hostFunctions struct {
+	mu  sync.RWMutex
+	fns map[string]hostFunction
+}
+
+func newHostFunctions() *hostFunctions {
+	return &hostFunctions{fns: map[string]hostFunction{}}
+}
+
+func hostFunctionKey(namespace, operation string) string {
+	return namespace + "/" + operation
+}
+
+func (h *hostFunctions) lookup(namespace, operation string) (hostFunction, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	fn, ok := h.fns[hostFunctionKey(namespace, operation)]
+	return fn, ok
+}
+
+// hostFunction wraps a reflect.Value of a function registered via
+// Module.RegisterHostFunction, decoding/encoding its arguments and results as
+// MessagePack.
+type hostFunction struct {
+	fn reflect.Value
+}
+
+// errorType is used to detect a function's trailing error result, which is
+// surfaced as the host error rather than encoded into the response.
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// call decodes payload as a MessagePack-encoded array of fn's parameters,
+// invokes fn, and encodes its (non-error) results as a MessagePack-encoded
+// array response.
+func (f hostFunction) call(payload []byte) ([]byte, error) {
+	t := f.fn.Type()
+
+	var rawArgs []msgpack.RawMessage
+	if n := t.NumIn(); n > 0 {
+		if err := msgpack.Unmarshal(payload, &rawArgs); err != nil {
+			return nil, fmt.Errorf("wapc: error decoding host function payload: %w", err)
+		}
+		if len(rawArgs) != n {
+			return nil, fmt.Errorf("wapc: host function expects %d argument(s), payload has %d", n, len(rawArgs))
+		}
+	}
+
+	args := make([]reflect.Value, t.NumIn())
+	for i := range args {
+		arg := reflect.New(t.In(i))
+		if err := msgpack.Unmarshal(rawArgs[i], arg.Interface()); err != nil {
+			return nil, fmt.Errorf("wapc: error decoding host function argument %d: %w", i, err)
+		}
+		args[i] = arg.Elem()
+	}
+
+	out := f.fn.Call(args)
+
+	// A trailing error result is surfaced as the host error, not encoded.
+	results := out
+	if n := len(out); n > 0 && t.Out(n-1) == errorType {
+		if err, _ := out[n-1].Interface().(error); err != nil {
+			return nil, err
+		}
+		results = out[:n-1]
+	}
+
+	if len(results) == 0 {
+		return nil, nil
+	}
+
+	vals := make([]interface{}, len(results))
+	for i, r := range results {
+		vals[i] = r.Interface()
+	}
+
+	resp, err := msgpack.Marshal(vals)
+	if err != nil {
+		return nil, fmt.Errorf("wapc: error encoding host function result: %w", err)
+	}
+	return resp, nil
+}
+
+// RegisterHostFunction registers fn so the guest can invoke it via __host_call
+// using namespace and operation, without either side hand-marshaling
+// MessagePack. fn's parameter and result types are inferred by reflection;
+// supported types are Go primitives (ints, floats, string, []byte) and
+// MessagePack-encodable structs. fn may optionally return an error as its
+// last result, which surfaces to the guest as a host error rather than being
+// encoded into the response.
+//
+// Registering a function for a namespace/operation pair that already has one
+// replaces it.
+func (m *Module) RegisterHostFunction(namespace, operation string, fn interface{}) error {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func {
+		return fmt.Errorf("wapc: RegisterHostFunction: fn must be a function, was %s", v.Kind())
+	}
+
+	m.hostFns.mu.Lock()
+	defer m.hostFns.mu.Unlock()
+	m.hostFns.fns[hostFunctionKey(namespace, operation)] = hostFunction{fn: v}
+	return nil
+}
+
+// UnregisterHostFunction removes a function previously registered with
+// RegisterHostFunction for namespace and operation. It is a no-op if none is
+// registered.
+func (m *Module) UnregisterHostFunction(namespace, operation string) {
+	m.hostFns.mu.Lock()
+	defer m.hostFns.mu.Unlock()
+	delete(m.hostFns.fns, hostFunctionKey(namespace, operation))
+}
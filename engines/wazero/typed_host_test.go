@@ -0,0 +1,105 @@
+package wazero
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// TestHostFunction_call_decodesArgsAndEncodesResult confirms hostFunction.call
+// decodes a MessagePack-encoded argument array into fn's declared parameter
+// types via reflection, and encodes fn's (non-error) results the same way.
+func TestHostFunction_call_decodesArgsAndEncodesResult(t *testing.T) {
+	fn := hostFunction{fn: reflect.ValueOf(func(a int, b string) (string, error) {
+		if a < 0 {
+			return "", errors.New("a must be non-negative")
+		}
+		return fmt.Sprintf("%s:%d", b, a), nil
+	})}
+
+	payload, err := msgpack.Marshal([]interface{}{5, "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := fn.call(payload)
+	if err != nil {
+		t.Fatalf("call() error = %v", err)
+	}
+
+	var results []string
+	if err := msgpack.Unmarshal(resp, &results); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	if want := []string{"x:5"}; !reflect.DeepEqual(results, want) {
+		t.Errorf("results = %v, want %v", results, want)
+	}
+}
+
+// TestHostFunction_call_trailingErrorIsNotEncoded confirms a non-nil trailing
+// error result is returned as the call's error rather than being encoded into
+// the response payload.
+func TestHostFunction_call_trailingErrorIsNotEncoded(t *testing.T) {
+	fn := hostFunction{fn: reflect.ValueOf(func(a int) (string, error) {
+		return "", errors.New("boom")
+	})}
+
+	payload, err := msgpack.Marshal([]interface{}{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fn.call(payload)
+	if err == nil || err.Error() != "boom" {
+		t.Fatalf("call() error = %v, want %q", err, "boom")
+	}
+}
+
+// TestHostFunction_call_argumentCountMismatch confirms a payload with the
+// wrong number of encoded arguments is rejected instead of panicking or
+// silently truncating.
+func TestHostFunction_call_argumentCountMismatch(t *testing.T) {
+	fn := hostFunction{fn: reflect.ValueOf(func(a, b int) int { return a + b })}
+
+	payload, err := msgpack.Marshal([]interface{}{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fn.call(payload); err == nil {
+		t.Fatal("call() error = nil, want an argument count mismatch error")
+	}
+}
+
+// TestModule_RegisterHostFunction_rejectsNonFunc confirms RegisterHostFunction
+// validates fn's kind before storing it, rather than panicking later inside
+// hostFunction.call's reflection.
+func TestModule_RegisterHostFunction_rejectsNonFunc(t *testing.T) {
+	m := &Module{hostFns: newHostFunctions()}
+
+	if err := m.RegisterHostFunction("ns", "op", "not a function"); err == nil {
+		t.Fatal("RegisterHostFunction error = nil, want an error for a non-function")
+	}
+}
+
+// TestModule_RegisterHostFunction_lookup confirms RegisterHostFunction and
+// UnregisterHostFunction make a host function discoverable (and then not) via
+// the "namespace/operation" key hostFunctions.lookup uses.
+func TestModule_RegisterHostFunction_lookup(t *testing.T) {
+	m := &Module{hostFns: newHostFunctions()}
+
+	if err := m.RegisterHostFunction("ns", "op", func() {}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.hostFns.lookup("ns", "op"); !ok {
+		t.Fatal("lookup(ns, op) ok = false, want true after RegisterHostFunction")
+	}
+
+	m.UnregisterHostFunction("ns", "op")
+	if _, ok := m.hostFns.lookup("ns", "op"); ok {
+		t.Fatal("lookup(ns, op) ok = true, want false after UnregisterHostFunction")
+	}
+}
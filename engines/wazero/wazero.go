@@ -4,11 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"sync/atomic"
 
 	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/api"
-	"github.com/tetratelabs/wazero/imports/assemblyscript"
+	"github.com/tetratelabs/wazero/experimental"
 	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
 
 	"github.com/wapc/wapc-go"
@@ -30,13 +31,23 @@ const functionInit = "wapc_init"
 const functionGuestCall = "__guest_call"
 
 type (
-	engine struct{ newRuntime NewRuntime }
+	engine struct {
+		newRuntime NewRuntime
+
+		// emscripten, when true, causes New to detect guests compiled with
+		// emcc and export the additional "env" imports they require.
+		emscripten bool
+	}
 
 	// Module represents a compiled waPC module.
 	Module struct {
 		// wapcHostCallHandler is the value of wapcHost.callHandler
 		wapcHostCallHandler wapc.HostCallHandler
 
+		// hostFns backs RegisterHostFunction and is consulted by wapcHost.hostCall
+		// before falling back to wapcHostCallHandler.
+		hostFns *hostFunctions
+
 		runtime  wazero.Runtime
 		compiled wazero.CompiledModule
 
@@ -44,6 +55,12 @@ type (
 
 		config wazero.ModuleConfig
 
+		// defaultInvokeOpts are applied to every Instance.Invoke call made on
+		// instances of this Module, e.g. the WithDeadline NewFromManifest
+		// derives from Manifest.Timeout. Instance.InvokeWithOptions ignores
+		// these: callers that invoke it directly specify their own bounds.
+		defaultInvokeOpts []InvokeOption
+
 		// closed is atomically updated to ensure Close is only invoked once.
 		closed uint32
 	}
@@ -53,6 +70,14 @@ type (
 		m         api.Module
 		guestCall api.Function
 
+		// defaultInvokeOpts is copied from the owning Module at Instantiate.
+		defaultInvokeOpts []InvokeOption
+
+		// guestCallMu serializes guestCall.Call and is held for the duration of
+		// a BeginInvoke, so host code handling that call can safely read back
+		// from or make further calls into the same api.Module (see Invocation).
+		guestCallMu sync.Mutex
+
 		// closed is atomically updated to ensure Close is only invoked once.
 		closed uint32
 	}
@@ -67,6 +92,24 @@ type (
 		hostResp []byte
 		hostErr  error
 	}
+
+	// Invocation is a handle on a single __guest_call made via
+	// Instance.BeginInvoke. Unlike the result of Invoke, an Invocation keeps
+	// the instance's guest-call lock held until Close, so host code
+	// correlated to this call (see InvocationFromContext) can safely read
+	// back from, or make further calls into, the same api.Module before the
+	// invocation is considered done.
+	Invocation struct {
+		instance *Instance
+		ctx      context.Context
+
+		operation string
+		result    []byte
+		err       error
+
+		// closed is atomically updated to ensure Close only unlocks once.
+		closed uint32
+	}
 )
 
 // Ensure the engine conforms to the waPC interface.
@@ -95,19 +138,19 @@ func (e *engine) Name() string {
 }
 
 // DefaultRuntime implements NewRuntime by returning a wazero runtime with WASI
-// and AssemblyScript host functions instantiated.
+// instantiated. The AssemblyScript (and, when enabled, emscripten) "env" host
+// module is instantiated separately by engine.New, once the guest has been
+// compiled and its imports are known.
 func DefaultRuntime(ctx context.Context) (wazero.Runtime, error) {
-	r := wazero.NewRuntime(ctx)
+	return newRuntime(ctx, wazero.NewRuntimeConfig())
+}
 
-	if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
-		_ = r.Close(ctx)
-		return nil, err
-	}
+// newRuntime instantiates a wazero.Runtime from rConfig, wiring in WASI, which
+// is common to every wazero-backed wapc.Engine regardless of guest toolchain.
+func newRuntime(ctx context.Context, rConfig wazero.RuntimeConfig) (wazero.Runtime, error) {
+	r := wazero.NewRuntimeWithConfig(ctx, rConfig)
 
-	// This disables the abort message as no other engines write it.
-	envBuilder := r.NewHostModuleBuilder("env")
-	assemblyscript.NewFunctionExporter().WithAbortMessageDisabled().ExportFunctions(envBuilder)
-	if _, err := envBuilder.Instantiate(ctx); err != nil {
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
 		_ = r.Close(ctx)
 		return nil, err
 	}
@@ -121,7 +164,7 @@ func (e *engine) New(ctx context.Context, host wapc.HostCallHandler, guest []byt
 		return nil, err
 	}
 
-	m := &Module{runtime: r, wapcHostCallHandler: host}
+	m := &Module{runtime: r, wapcHostCallHandler: host, hostFns: newHostFunctions()}
 
 	m.config = wazero.NewModuleConfig().
 		WithStartFunctions(functionStart, functionInit) // Call any WASI or waPC start functions on instantiate.
@@ -134,12 +177,23 @@ func (e *engine) New(ctx context.Context, host wapc.HostCallHandler, guest []byt
 	}
 	mod = m
 
-	if _, err = instantiateWapcHost(ctx, r, m.wapcHostCallHandler, config.Logger); err != nil {
+	if _, err = instantiateWapcHost(ctx, r, m.wapcHostCallHandler, config.Logger, m.hostFns); err != nil {
+		_ = r.Close(ctx)
+		return
+	}
+
+	// WithFuel's budget is only known per Invoke call, long after the guest is
+	// compiled, but wazero only consults a FunctionListenerFactory from the
+	// ctx passed to CompileModule. So a single stateless fuelListenerFactory
+	// is installed here, unconditionally; it is a no-op unless the ctx of a
+	// given function call was itself tagged by WithFuel (see limits.go).
+	compileCtx := experimental.WithFunctionListenerFactory(ctx, fuelListenerFactory{})
+	if m.compiled, err = r.CompileModule(compileCtx, guest); err != nil {
 		_ = r.Close(ctx)
 		return
 	}
 
-	if m.compiled, err = r.CompileModule(ctx, guest); err != nil {
+	if err = instantiateEnvModule(ctx, r, m.compiled, e.emscripten); err != nil {
 		_ = r.Close(ctx)
 		return
 	}
@@ -168,14 +222,30 @@ type wapcHost struct {
 
 	// logger is used to implement consoleLog.
 	logger wapc.Logger
+
+	// hostFns holds any functions registered via Module.RegisterHostFunction.
+	// hostCall dispatches to these before falling back to callHandler.
+	hostFns *hostFunctions
+
+	// allow, when non-nil, restricts hostCall to the namespace/operation pairs
+	// it contains; see Manifest.AllowedHosts.
+	allow *allowList
 }
 
 // instantiateWapcHost instantiates a wapcHost and returns it and its corresponding module, or an error.
 //   - r: used to instantiate the waPC host module
 //   - callHandler: used to implement hostCall
 //   - logger: used to implement consoleLog
-func instantiateWapcHost(ctx context.Context, r wazero.Runtime, callHandler wapc.HostCallHandler, logger wapc.Logger) (api.Module, error) {
-	h := &wapcHost{callHandler: callHandler, logger: logger}
+//   - hostFns: used to dispatch typed host functions registered via Module.RegisterHostFunction
+func instantiateWapcHost(ctx context.Context, r wazero.Runtime, callHandler wapc.HostCallHandler, logger wapc.Logger, hostFns *hostFunctions) (api.Module, error) {
+	return instantiateWapcHostWithAllowList(ctx, r, callHandler, logger, hostFns, nil)
+}
+
+// instantiateWapcHostWithAllowList is like instantiateWapcHost, except hostCall
+// rejects any namespace/operation pair not permitted by allow. A nil allow
+// permits everything; see Manifest.AllowedHosts.
+func instantiateWapcHostWithAllowList(ctx context.Context, r wazero.Runtime, callHandler wapc.HostCallHandler, logger wapc.Logger, hostFns *hostFunctions, allow *allowList) (api.Module, error) {
+	h := &wapcHost{callHandler: callHandler, logger: logger, hostFns: hostFns, allow: allow}
 	// Export host functions (in the order defined in https://wapc.io/docs/spec/#required-host-exports)
 	// Note: These are defined manually (without reflection) for higher performance as waPC is a foundational library.
 	return r.NewHostModuleBuilder("wapc").
@@ -229,8 +299,8 @@ func (w *wapcHost) hostCall(ctx context.Context, m api.Module, stack []uint64) {
 	payloadLen := uint32(stack[7])
 
 	ic := fromInvokeContext(ctx)
-	if ic == nil || w.callHandler == nil {
-		stack[0] = 0 // false: neither an invocation context, nor a callHandler
+	if ic == nil {
+		stack[0] = 0 // false: no invocation context
 		return
 	}
 
@@ -240,6 +310,27 @@ func (w *wapcHost) hostCall(ctx context.Context, m api.Module, stack []uint64) {
 	operation := requireReadString(mem, "operation", cmdPtr, cmdLen)
 	payload := requireRead(mem, "payload", payloadPtr, payloadLen)
 
+	if !w.allow.allowed(namespace, operation) {
+		ic.hostErr = fmt.Errorf("forbidden: host call %s/%s is not in the manifest's allowed hosts", namespace, operation)
+		stack[0] = 0 // false: not permitted by the manifest's allow list
+		return
+	}
+
+	if fn, ok := w.hostFns.lookup(namespace, operation); ok {
+		if ic.hostResp, ic.hostErr = fn.call(payload); ic.hostErr != nil {
+			stack[0] = 0
+		} else {
+			stack[0] = 1
+		}
+		return
+	}
+
+	if w.callHandler == nil {
+		ic.hostErr = fmt.Errorf("unknown operation: %s/%s", namespace, operation)
+		stack[0] = 0 // false: no handler registered for this call
+		return
+	}
+
 	if ic.hostResp, ic.hostErr = w.callHandler(ctx, binding, namespace, operation, payload); ic.hostErr != nil {
 		stack[0] = 0 // false: error (assumed to be logged already?)
 	} else {
@@ -371,7 +462,7 @@ func (m *Module) Instantiate(ctx context.Context) (wapc.Instance, error) {
 		return nil, err
 	}
 
-	instance := Instance{name: moduleName, m: module}
+	instance := Instance{name: moduleName, m: module, defaultInvokeOpts: m.defaultInvokeOpts}
 
 	if instance.guestCall = module.ExportedFunction(functionGuestCall); instance.guestCall == nil {
 		_ = module.Close(ctx)
@@ -406,32 +497,135 @@ func (i *Instance) UnwrapModule() api.Module {
 	return i.m
 }
 
-// Invoke implements the same method as documented on wapc.Instance.
+type invocationContextKey struct{}
+
+func newInvocationContext(ctx context.Context, inv *Invocation) context.Context {
+	return context.WithValue(ctx, invocationContextKey{}, inv)
+}
+
+// InvocationFromContext returns the *Invocation a BeginInvoke call is
+// running under, if any. A ctx passed to a wapc.HostCallHandler, or to a
+// function registered via Module.RegisterHostFunction, carries an
+// Invocation when it was reached through BeginInvoke (including via Invoke,
+// which is implemented in terms of it), allowing that host code to issue
+// further calls into the same guest with Invocation.CallGuestExport.
+func InvocationFromContext(ctx context.Context) (*Invocation, bool) {
+	inv, ok := ctx.Value(invocationContextKey{}).(*Invocation)
+	return inv, ok
+}
+
+// Invoke implements the same method as documented on wapc.Instance. It is
+// equivalent to InvokeWithOptions with this Instance's defaultInvokeOpts,
+// e.g. the WithDeadline NewFromManifest derives from Manifest.Timeout.
 func (i *Instance) Invoke(ctx context.Context, operation string, payload []byte) ([]byte, error) {
+	return i.InvokeWithOptions(ctx, operation, payload, i.defaultInvokeOpts...)
+}
+
+// InvokeWithOptions is like Invoke, except it accepts InvokeOption to bound
+// the call, e.g. WithDeadline or WithFuel.
+func (i *Instance) InvokeWithOptions(ctx context.Context, operation string, payload []byte, opts ...InvokeOption) ([]byte, error) {
+	inv, err := i.BeginInvoke(ctx, operation, payload, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer inv.Close(ctx)
+	return inv.Result(), inv.Err()
+}
+
+// BeginInvoke is like Invoke, except it returns an *Invocation instead of
+// the raw guest response. BeginInvoke holds the instance's guest-call lock
+// until the returned Invocation's Close method is called, so host code
+// correlated to this call via InvocationFromContext (for example a
+// wapc.HostCallHandler, or a function registered with
+// Module.RegisterHostFunction) can safely call back into the same guest
+// with Invocation.CallGuestExport, even after __guest_call has returned --
+// e.g. to stream a response body or attach trailers. Most callers should
+// use Invoke or InvokeWithOptions; BeginInvoke is for host integrations
+// that must keep a guest call and its instance correlated beyond the
+// initial call.
+func (i *Instance) BeginInvoke(ctx context.Context, operation string, payload []byte, opts ...InvokeOption) (*Invocation, error) {
 	if closed := atomic.LoadUint32(&i.closed); closed != 0 {
 		return nil, fmt.Errorf("error invoking guest with closed instance")
 	}
 	// Note: There's still a race below, even if the above check is still useful.
 
+	i.guestCallMu.Lock()
+
+	o := invokeOptions{}
+	for _, opt := range opts {
+		opt.apply(&o)
+	}
+
 	ic := invokeContext{operation: operation, guestReq: payload}
+	inv := &Invocation{instance: i, operation: operation}
 	ctx = newInvokeContext(ctx, &ic)
+	ctx = newInvocationContext(ctx, inv)
+
+	var limit *invokeLimit
+	ctx, limit = o.apply(ctx, i.m)
+	defer limit.stop()
+	inv.ctx = ctx
 
 	results, err := i.guestCall.Call(ctx, uint64(len(operation)), uint64(len(payload)))
 	if err != nil {
+		i.guestCallMu.Unlock()
+		if limit.timedOut() {
+			return nil, &TimeoutError{Operation: operation, Deadline: o.deadline}
+		}
+		if limit.fuelExhausted() {
+			return nil, &FuelExhaustedError{Operation: operation, Fuel: o.fuel}
+		}
 		return nil, fmt.Errorf("error invoking guest: %w", err)
 	}
+
 	if ic.guestErr != "" { // guestErr is not nil if the guest called "__guest_error".
-		return nil, errors.New(ic.guestErr)
+		inv.err = errors.New(ic.guestErr)
+	} else if results[0] == 1 { // guestResp is not nil if the guest called "__guest_response".
+		inv.result = ic.guestResp
+	} else {
+		inv.err = fmt.Errorf("call to %q was unsuccessful", operation)
 	}
 
-	result := results[0]
-	success := result == 1
+	return inv, nil
+}
+
+// Result returns the guest's response payload for this invocation, or nil
+// if the invocation produced an error; see Err.
+func (inv *Invocation) Result() []byte {
+	return inv.result
+}
+
+// Err returns the error, if any, produced by this invocation -- either a
+// guest error (see __guest_error) or an unsuccessful __guest_call result.
+func (inv *Invocation) Err() error {
+	return inv.err
+}
+
+// CallGuestExport calls the guest-exported function named name with args,
+// reusing the api.Module and context this invocation ran under. This is
+// only valid between BeginInvoke and Close, while this invocation still
+// holds the instance's guest-call lock.
+func (inv *Invocation) CallGuestExport(name string, args ...uint64) ([]uint64, error) {
+	if closed := atomic.LoadUint32(&inv.closed); closed != 0 {
+		return nil, fmt.Errorf("error calling %q on a closed invocation", name)
+	}
 
-	if success { // guestResp is not nil if the guest called "__guest_response".
-		return ic.guestResp, nil
+	fn := inv.instance.m.ExportedFunction(name)
+	if fn == nil {
+		return nil, fmt.Errorf("guest didn't export function %s", name)
 	}
+	return fn.Call(inv.ctx, args...)
+}
 
-	return nil, fmt.Errorf("call to %q was unsuccessful", operation)
+// Close releases the instance's guest-call lock acquired by BeginInvoke,
+// allowing other calls to proceed on the instance. It is safe to call Close
+// more than once.
+func (inv *Invocation) Close(_ context.Context) error {
+	if !atomic.CompareAndSwapUint32(&inv.closed, 0, 1) {
+		return nil
+	}
+	inv.instance.guestCallMu.Unlock()
+	return nil
 }
 
 // Close implements the same method as documented on wapc.Instance.